@@ -0,0 +1,54 @@
+package health
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/luizbafilho/fusis/types"
+)
+
+// scriptChecker reports a destination healthy when an external command
+// exits zero. The command runs with its configured Args only; the
+// destination's address is passed in the FUSIS_DESTINATION_HOST and
+// FUSIS_DESTINATION_PORT environment variables.
+type scriptChecker struct {
+	command string
+	args    []string
+	timeout time.Duration
+}
+
+func newScriptChecker(cfg Config) *scriptChecker {
+	return &scriptChecker{
+		command: cfg.Command,
+		args:    cfg.Args,
+		timeout: cfg.Timeout,
+	}
+}
+
+func (c *scriptChecker) Check(dst types.Destination) error {
+	cmd := exec.Command(c.command, c.args...)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("FUSIS_DESTINATION_HOST=%s", dst.Host),
+		fmt.Sprintf("FUSIS_DESTINATION_PORT=%d", dst.Port),
+	)
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("[health] script check %q failed to start: %v", c.command, err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("[health] script check %q failed: %v", c.command, err)
+		}
+		return nil
+	case <-time.After(c.timeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("[health] script check %q timed out after %s", c.command, c.timeout)
+	}
+}
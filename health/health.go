@@ -0,0 +1,90 @@
+// Package health implements destination health checking for fusis. It
+// gives the IPVS sync loop a way to tell a temporarily unreachable
+// destination apart from one the operator actually removed, so unhealthy
+// destinations can be pulled out of rotation and re-added automatically
+// once they recover.
+package health
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/luizbafilho/fusis/types"
+)
+
+// Status represents the current health state of a destination.
+type Status int
+
+const (
+	// Unknown is the zero Status. Monitor.Status never returns it: a
+	// destination with no recorded transition yet is reported Healthy.
+	Unknown Status = iota
+	// Healthy destinations are kept in the IPVS stateSet.
+	Healthy
+	// Unhealthy destinations are excluded from the IPVS stateSet until
+	// they recover.
+	Unhealthy
+)
+
+func (s Status) String() string {
+	switch s {
+	case Healthy:
+		return "healthy"
+	case Unhealthy:
+		return "unhealthy"
+	default:
+		return "unknown"
+	}
+}
+
+// Config holds the per-destination health check configuration, modelled
+// after the interval/timeout/threshold checks used by Consul and Nomad.
+type Config struct {
+	// Type selects the Checker implementation: "tcp", "http", "https" or
+	// "script". Defaults to "tcp".
+	Type string
+
+	Interval time.Duration
+	Timeout  time.Duration
+
+	// HealthyThreshold is the number of consecutive successes required
+	// to move a destination from Unhealthy to Healthy.
+	HealthyThreshold int
+	// UnhealthyThreshold is the number of consecutive failures required
+	// to move a destination from Healthy to Unhealthy.
+	UnhealthyThreshold int
+
+	// HTTP(S) checks
+	Path           string
+	ExpectedStatus int
+	ExpectedBody   string // regexp matched against the response body
+
+	// Script checks
+	Command string
+	Args    []string
+}
+
+// Checker probes a single destination and reports whether it is healthy.
+// Implementations must be safe to call repeatedly on a timer and should
+// not block past the configured Timeout.
+type Checker interface {
+	Check(dst types.Destination) error
+}
+
+// NewChecker builds the Checker implementation configured by cfg.Type.
+func NewChecker(cfg Config) (Checker, error) {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+
+	switch cfg.Type {
+	case "tcp", "":
+		return newTCPChecker(cfg), nil
+	case "http", "https":
+		return newHTTPChecker(cfg), nil
+	case "script":
+		return newScriptChecker(cfg), nil
+	default:
+		return nil, fmt.Errorf("[health] unknown check type: %q", cfg.Type)
+	}
+}
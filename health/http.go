@@ -0,0 +1,79 @@
+package health
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/luizbafilho/fusis/types"
+)
+
+// httpChecker reports a destination healthy when a GET request against it
+// returns the expected status code and, if configured, its body matches
+// ExpectedBody.
+type httpChecker struct {
+	scheme         string
+	path           string
+	expectedStatus int
+	expectedBody   *regexp.Regexp
+	client         *http.Client
+}
+
+func newHTTPChecker(cfg Config) *httpChecker {
+	scheme := "http"
+	if cfg.Type == "https" {
+		scheme = "https"
+	}
+
+	path := cfg.Path
+	if path == "" {
+		path = "/"
+	}
+
+	expectedStatus := cfg.ExpectedStatus
+	if expectedStatus == 0 {
+		expectedStatus = http.StatusOK
+	}
+
+	var expectedBody *regexp.Regexp
+	if cfg.ExpectedBody != "" {
+		expectedBody = regexp.MustCompile(cfg.ExpectedBody)
+	}
+
+	return &httpChecker{
+		scheme:         scheme,
+		path:           path,
+		expectedStatus: expectedStatus,
+		expectedBody:   expectedBody,
+		client:         &http.Client{Timeout: cfg.Timeout},
+	}
+}
+
+func (c *httpChecker) Check(dst types.Destination) error {
+	url := fmt.Sprintf("%s://%s%s", c.scheme, net.JoinHostPort(dst.Host, fmt.Sprintf("%d", dst.Port)), c.path)
+
+	resp, err := c.client.Get(url)
+	if err != nil {
+		return fmt.Errorf("[health] http check to %s failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != c.expectedStatus {
+		return fmt.Errorf("[health] http check to %s got status %d, wanted %d", url, resp.StatusCode, c.expectedStatus)
+	}
+
+	if c.expectedBody != nil {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("[health] http check to %s: reading body: %v", url, err)
+		}
+		if !c.expectedBody.Match(body) {
+			return fmt.Errorf("[health] http check to %s: body did not match %q", url, c.expectedBody.String())
+		}
+	}
+
+	return nil
+}
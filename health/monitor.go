@@ -0,0 +1,113 @@
+package health
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"github.com/luizbafilho/fusis/types"
+)
+
+// OnChangeFunc is invoked whenever a destination's health status flips,
+// after the configured threshold has been met. Callers typically use this
+// to trigger an immediate Sync instead of waiting for the next reconcile
+// tick.
+type OnChangeFunc func(dst types.Destination, status Status)
+
+// Monitor runs one Checker per watched destination and keeps track of its
+// current Status, applying the healthy/unhealthy thresholds before
+// reporting a transition.
+type Monitor struct {
+	mu       sync.RWMutex
+	statuses map[string]Status
+
+	onChange OnChangeFunc
+}
+
+// NewMonitor creates an empty Monitor. onChange may be nil.
+func NewMonitor(onChange OnChangeFunc) *Monitor {
+	return &Monitor{
+		statuses: map[string]Status{},
+		onChange: onChange,
+	}
+}
+
+// Status returns the last known status for the destination with the given
+// id. Destinations with no registered check are reported Healthy, so they
+// are never excluded from the stateSet by default.
+func (m *Monitor) Status(id string) Status {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	status, ok := m.statuses[id]
+	if !ok {
+		return Healthy
+	}
+	return status
+}
+
+// Watch runs checker against dst every cfg.Interval until ctx is
+// cancelled, updating the Monitor's view of dst's Status once the
+// configured threshold of consecutive successes or failures is reached.
+func (m *Monitor) Watch(ctx context.Context, dst types.Destination, checker Checker, cfg Config) {
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	healthyThreshold := cfg.HealthyThreshold
+	if healthyThreshold <= 0 {
+		healthyThreshold = 2
+	}
+	unhealthyThreshold := cfg.UnhealthyThreshold
+	if unhealthyThreshold <= 0 {
+		unhealthyThreshold = 2
+	}
+
+	var consecutiveOK, consecutiveFail int
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := checker.Check(dst); err != nil {
+				consecutiveOK = 0
+				consecutiveFail++
+				log.Debugf("[health] check failed for %s: %v", dst.GetId(), err)
+				if consecutiveFail >= unhealthyThreshold {
+					m.transition(dst, Unhealthy)
+				}
+				continue
+			}
+
+			consecutiveFail = 0
+			consecutiveOK++
+			if consecutiveOK >= healthyThreshold {
+				m.transition(dst, Healthy)
+			}
+		}
+	}
+}
+
+func (m *Monitor) transition(dst types.Destination, status Status) {
+	id := dst.GetId()
+
+	m.mu.Lock()
+	previous, ok := m.statuses[id]
+	if ok && previous == status {
+		m.mu.Unlock()
+		return
+	}
+	m.statuses[id] = status
+	m.mu.Unlock()
+
+	log.Infof("[health] destination %s transitioned from %s to %s", id, previous, status)
+	if m.onChange != nil {
+		m.onChange(dst, status)
+	}
+}
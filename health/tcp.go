@@ -0,0 +1,29 @@
+package health
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/luizbafilho/fusis/types"
+)
+
+// tcpChecker reports a destination healthy if a TCP connection to it can
+// be established within the configured timeout.
+type tcpChecker struct {
+	timeout time.Duration
+}
+
+func newTCPChecker(cfg Config) *tcpChecker {
+	return &tcpChecker{timeout: cfg.Timeout}
+}
+
+func (c *tcpChecker) Check(dst types.Destination) error {
+	addr := net.JoinHostPort(dst.Host, fmt.Sprintf("%d", dst.Port))
+
+	conn, err := net.DialTimeout("tcp", addr, c.timeout)
+	if err != nil {
+		return fmt.Errorf("[health] tcp check to %s failed: %v", addr, err)
+	}
+	return conn.Close()
+}
@@ -0,0 +1,43 @@
+package ipvs
+
+import (
+	gipvs "github.com/google/seesaw/ipvs"
+)
+
+// kernelBackend is the subset of gipvs used by the sync path. It exists so
+// the plan/apply/rollback logic in plan.go can be exercised against an
+// in-memory fake, since gipvs itself talks to the real kernel over
+// netlink and has no test double of its own. gipvs has no batch API, so
+// each kernelBackend call is still one netlink round-trip; batching
+// multiple ops into a single NLM_F_MULTI transaction would mean
+// vendoring netlink directly (e.g. vishvananda/netlink) in place of
+// gipvs, which is out of scope here.
+type kernelBackend interface {
+	AddService(svc gipvs.Service) error
+	DeleteService(svc gipvs.Service) error
+	AddDestination(svc gipvs.Service, dst gipvs.Destination) error
+	DeleteDestination(svc gipvs.Service, dst gipvs.Destination) error
+	GetServices() ([]*gipvs.Service, error)
+	GetService(svc *gipvs.Service) (*gipvs.Service, error)
+	Flush() error
+}
+
+// gipvsBackend implements kernelBackend against the real IPVS table via
+// gipvs/netlink.
+type gipvsBackend struct{}
+
+func (gipvsBackend) AddService(svc gipvs.Service) error     { return gipvs.AddService(svc) }
+func (gipvsBackend) DeleteService(svc gipvs.Service) error  { return gipvs.DeleteService(svc) }
+func (gipvsBackend) Flush() error                           { return gipvs.Flush() }
+func (gipvsBackend) GetServices() ([]*gipvs.Service, error) { return gipvs.GetServices() }
+func (gipvsBackend) GetService(svc *gipvs.Service) (*gipvs.Service, error) {
+	return gipvs.GetService(svc)
+}
+
+func (gipvsBackend) AddDestination(svc gipvs.Service, dst gipvs.Destination) error {
+	return gipvs.AddDestination(svc, dst)
+}
+
+func (gipvsBackend) DeleteDestination(svc gipvs.Service, dst gipvs.Destination) error {
+	return gipvs.DeleteDestination(svc, dst)
+}
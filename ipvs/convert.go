@@ -0,0 +1,187 @@
+package ipvs
+
+import (
+	"net"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	gipvs "github.com/google/seesaw/ipvs"
+
+	"github.com/luizbafilho/fusis/types"
+)
+
+// These mirror the IP_VS_SVC_F_PERSISTENT and IP_VS_SVC_F_SCHED1/SCHED2
+// flags from linux/ip_vs.h. The sh scheduler interprets SCHED1/SCHED2 as
+// sh-fallback/sh-port. The persistent flag is set whenever
+// PersistenceTimeout is non-zero.
+const (
+	svcFlagPersistent      = 1 << 0
+	svcFlagSchedSHFallback = 1 << 3
+	svcFlagSchedSHPort     = 1 << 4
+)
+
+// These mirror the IP_VS_CONN_F_FWD_MASK forwarding method values from
+// linux/ip_vs.h.
+const (
+	connFlagMasq   = 0 // NAT
+	connFlagTunnel = 2 // IP-IP tunnelling
+	connFlagRoute  = 3 // Direct routing
+)
+
+func toGipvsFamily(af types.AddressFamily) gipvs.AddressFamily {
+	if af == types.INET6 {
+		return gipvs.INET6
+	}
+	return gipvs.INET
+}
+
+func fromGipvsFamily(af gipvs.AddressFamily) types.AddressFamily {
+	if af == gipvs.INET6 {
+		return types.INET6
+	}
+	return types.INET
+}
+
+// gipvs.IPProto is a numeric protocol number (matching IPPROTO_TCP/
+// IPPROTO_UDP from linux/in.h), not a string, so it needs an explicit
+// mapping rather than a raw conversion.
+const (
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+)
+
+func toIPProto(protocol string) gipvs.IPProto {
+	if strings.EqualFold(protocol, "udp") {
+		return gipvs.IPProto(ipProtoUDP)
+	}
+	return gipvs.IPProto(ipProtoTCP)
+}
+
+func fromIPProto(proto gipvs.IPProto) string {
+	if proto == ipProtoUDP {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// ToIpvsService converts a types.Service into the gipvs.Service consumed
+// by the kernel netlink calls. The friendly Algorithm/SessionAffinity
+// annotations are resolved to their kernel-level Scheduler/
+// PersistenceTimeout/Netmask fields first.
+func ToIpvsService(svc *types.Service) *gipvs.Service {
+	if err := svc.Resolve(); err != nil {
+		// Validate should have caught this at the API layer; fall back
+		// to whatever Scheduler/persistence was already set.
+		log.Errorf("[ipvs] resolving service %s: %v", svc.Name, err)
+	}
+
+	ipvsSvc := &gipvs.Service{
+		Address:       net.ParseIP(svc.Host),
+		Port:          svc.Port,
+		Protocol:      toIPProto(svc.Protocol),
+		Scheduler:     svc.Scheduler,
+		FirewallMark:  svc.FWMark,
+		AddressFamily: toGipvsFamily(svc.AddressFamily),
+		Timeout:       uint32(svc.PersistenceTimeout),
+	}
+
+	if svc.PersistenceNetmask != "" {
+		if ip := net.ParseIP(svc.PersistenceNetmask); ip != nil {
+			ipvsSvc.Netmask = net.IP(ip).String()
+		}
+	}
+
+	var flags uint32
+	if svc.PersistenceTimeout > 0 {
+		flags |= svcFlagPersistent
+	}
+	if svc.SchedFlags.SHFallback {
+		flags |= svcFlagSchedSHFallback
+	}
+	if svc.SchedFlags.SHPort {
+		flags |= svcFlagSchedSHPort
+	}
+	ipvsSvc.Flags = gipvs.ServiceFlags(flags)
+
+	return ipvsSvc
+}
+
+// FromService converts a gipvs.Service, as read back from the kernel,
+// into a types.Service. Fields not meaningful to the stateSet equality
+// check (Name, Mode) are left zero, matching getStateServicesSet's own
+// clean up.
+func FromService(svc *gipvs.Service) types.Service {
+	s := types.Service{
+		Host:          svc.Address.String(),
+		Port:          svc.Port,
+		Protocol:      fromIPProto(svc.Protocol),
+		Scheduler:     svc.Scheduler,
+		AddressFamily: fromGipvsFamily(svc.AddressFamily),
+		FWMark:        svc.FirewallMark,
+	}
+
+	if svc.Timeout > 0 {
+		s.PersistenceTimeout = int(svc.Timeout)
+		s.PersistenceNetmask = svc.Netmask
+	}
+
+	flags := uint32(svc.Flags)
+	s.SchedFlags = types.SchedFlags{
+		SHFallback: flags&svcFlagSchedSHFallback != 0,
+		SHPort:     flags&svcFlagSchedSHPort != 0,
+	}
+
+	return s
+}
+
+func toConnFlag(ct types.ConnectionType) uint32 {
+	switch ct {
+	case types.TUN:
+		return connFlagTunnel
+	case types.DR:
+		return connFlagRoute
+	default:
+		return connFlagMasq
+	}
+}
+
+func fromConnFlag(flags uint32) types.ConnectionType {
+	switch flags & 0x3 {
+	case connFlagTunnel:
+		return types.TUN
+	case connFlagRoute:
+		return types.DR
+	default:
+		return types.NAT
+	}
+}
+
+// ToIpvsDestination converts a types.Destination into the
+// gipvs.Destination consumed by the kernel netlink calls.
+func ToIpvsDestination(dst *types.Destination) *gipvs.Destination {
+	return &gipvs.Destination{
+		Address:        net.ParseIP(dst.Host),
+		Port:           dst.Port,
+		Weight:         int32(dst.Weight),
+		Flags:          gipvs.DestinationFlags(toConnFlag(dst.ConnectionType)),
+		AddressFamily:  toGipvsFamily(dst.AddressFamily),
+		UpperThreshold: dst.UpperThreshold,
+		LowerThreshold: dst.LowerThreshold,
+	}
+}
+
+// fromDestination converts a gipvs.Destination, as read back from the
+// kernel, into a types.Destination. Fields not meaningful to the
+// stateSet equality check (Name, ServiceId) are left zero, matching
+// getStateDestinationsSet's own clean up.
+func fromDestination(dst *gipvs.Destination) types.Destination {
+	return types.Destination{
+		Host:           dst.Address.String(),
+		Port:           dst.Port,
+		Weight:         int(dst.Weight),
+		AddressFamily:  fromGipvsFamily(dst.AddressFamily),
+		ConnectionType: fromConnFlag(uint32(dst.Flags)),
+		UpperThreshold: dst.UpperThreshold,
+		LowerThreshold: dst.LowerThreshold,
+	}
+}
@@ -0,0 +1,26 @@
+package ipvs
+
+import (
+	"time"
+
+	"github.com/luizbafilho/fusis/health"
+	"github.com/luizbafilho/fusis/types"
+)
+
+// toHealthConfig translates a destination's user-facing HealthCheck
+// annotation into the health package's own Config, so types has no
+// dependency on health.
+func toHealthConfig(hc *types.HealthCheck) health.Config {
+	return health.Config{
+		Type:               hc.Type,
+		Interval:           time.Duration(hc.IntervalSeconds) * time.Second,
+		Timeout:            time.Duration(hc.TimeoutSeconds) * time.Second,
+		HealthyThreshold:   hc.HealthyThreshold,
+		UnhealthyThreshold: hc.UnhealthyThreshold,
+		Path:               hc.Path,
+		ExpectedStatus:     hc.ExpectedStatus,
+		ExpectedBody:       hc.ExpectedBody,
+		Command:            hc.Command,
+		Args:               hc.Args,
+	}
+}
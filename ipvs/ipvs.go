@@ -8,12 +8,20 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/deckarep/golang-set"
 	gipvs "github.com/google/seesaw/ipvs"
-	"github.com/luizbafilho/fusis/types"
+	"golang.org/x/net/context"
+
+	"github.com/luizbafilho/fusis/health"
 	"github.com/luizbafilho/fusis/state"
+	"github.com/luizbafilho/fusis/statemanager"
+	"github.com/luizbafilho/fusis/types"
 )
 
 type Ipvs struct {
 	sync.Mutex
+
+	backend      kernelBackend
+	health       *health.Monitor
+	stateManager *statemanager.Manager
 }
 
 type Syncer interface {
@@ -24,8 +32,13 @@ func loadIpvsModule() error {
 	return exec.Command("modprobe", "ip_vs").Run()
 }
 
-//New creates a new ipvs struct and flushes the IPVS Table
-func New() (*Ipvs, error) {
+// New creates a new Ipvs struct. Unlike before, it no longer flushes the
+// IPVS table unconditionally: it loads the last state persisted under
+// stateDir and reconciles only the delta against whatever is currently
+// programmed in the kernel, so a restart or a crash of fusisd never
+// drops rules that are still valid and doesn't interrupt in-flight
+// connections.
+func New(stateDir string) (*Ipvs, error) {
 	if err := loadIpvsModule(); err != nil {
 		return nil, err
 	}
@@ -34,103 +47,91 @@ func New() (*Ipvs, error) {
 		return nil, fmt.Errorf("[ipvs] Initialisation failed: %v", err)
 	}
 
-	ipvs := &Ipvs{}
-	if err := ipvs.Flush(); err != nil {
-		return nil, fmt.Errorf("[ipvs] Flushing table failed: %v", err)
+	sm, err := statemanager.New(stateDir)
+	if err != nil {
+		return nil, fmt.Errorf("[ipvs] opening state manager: %v", err)
 	}
 
-	return ipvs, nil
-}
+	ipvs := &Ipvs{backend: gipvsBackend{}, stateManager: sm}
 
-// Sync syncs all ipvs rules present in state to kernel
-func (ipvs *Ipvs) Sync(state state.State) error {
-	ipvs.Lock()
-	defer ipvs.Unlock()
-	log.Debug("[ipvs] Syncing")
-
-	stateSet := ipvs.getStateServicesSet(state)
-	currentSet, err := ipvs.getCurrentServicesSet()
+	clean, err := sm.WasCleanShutdown()
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	rulesToAdd := stateSet.Difference(currentSet)
-	rulesToRemove := currentSet.Difference(stateSet)
-
-	// Adding services and destinations missing
-	for r := range rulesToAdd.Iter() {
-		service := r.(types.Service)
-		dsts := state.GetDestinations(&service)
-
-		if err := ipvs.addServiceAndDestinations(service, dsts); err != nil {
-			return err
-		}
-		log.Debugf("[ipvs] Added service: %#v with destinations: %#v", service, dsts)
+	if !clean {
+		log.Warn("[ipvs] unclean shutdown detected, recovering from persisted state")
 	}
 
-	// Cleaning rules
-	for r := range rulesToRemove.Iter() {
-		service := r.(types.Service)
-		err := gipvs.DeleteService(*ToIpvsService(&service))
-		if err != nil {
-			return err
-		}
-		log.Debugf("[ipvs] Removed service: %#v", service)
+	snapshot, err := sm.Load()
+	if err != nil {
+		return nil, err
 	}
 
-	// Syncing destination rules
-	for _, s := range state.GetServices() {
-		if err := ipvs.syncDestinations(state, s); err != nil {
-			return err
-		}
+	recoveryPlan, err := ipvs.buildPlanFromSnapshot(snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("[ipvs] diffing persisted state failed: %v", err)
+	}
+	if err := apply(ipvs.backend, recoveryPlan); err != nil {
+		return nil, fmt.Errorf("[ipvs] reconciling persisted state failed: %v", err)
 	}
 
-	return nil
+	return ipvs, nil
+}
+
+// Close records a clean-shutdown marker so the next New doesn't treat
+// this as a crash recovery.
+func (ipvs *Ipvs) Close() error {
+	return ipvs.stateManager.Close()
 }
 
-func (ipvs *Ipvs) syncDestinations(state state.State, svc types.Service) error {
-	stateSet := ipvs.getStateDestinationsSet(state, svc)
-	currentSet, err := ipvs.getCurrentDestinationsSet(svc)
+// Sync syncs all ipvs rules present in state to the kernel. It builds a
+// single plan covering every service and destination add/remove needed,
+// then applies it as one unit: if any op in the plan fails, every op
+// that already landed is rolled back so kernel state never diverges
+// from what Sync reports as applied.
+func (ipvs *Ipvs) Sync(state state.State) error {
+	ipvs.Lock()
+	defer ipvs.Unlock()
+	log.Debug("[ipvs] Syncing")
+
+	p, err := ipvs.buildPlan(state)
 	if err != nil {
 		return err
 	}
 
-	rulesToAdd := stateSet.Difference(currentSet)
-	rulesToRemove := currentSet.Difference(stateSet)
+	if p.isEmpty() {
+		return nil
+	}
 
-	for r := range rulesToAdd.Iter() {
-		destination := r.(types.Destination)
-		if err := gipvs.AddDestination(*ToIpvsService(&svc), *ToIpvsDestination(&destination)); err != nil {
-			return err
-		}
+	if err := apply(ipvs.backend, p); err != nil {
+		return err
 	}
+	log.Debugf("[ipvs] Applied plan: %d service adds, %d service removes, %d destination diffs",
+		len(p.serviceAdds), len(p.serviceRemoves), len(p.destinationDiffs))
 
-	for r := range rulesToRemove.Iter() {
-		destination := r.(types.Destination)
-		err := gipvs.DeleteDestination(*ToIpvsService(&svc), *ToIpvsDestination(&destination))
-		if err != nil {
-			return err
+	if ipvs.stateManager != nil {
+		if err := ipvs.stateManager.Save(snapshotOf(state)); err != nil {
+			log.Errorf("[ipvs] persisting state after sync failed: %v", err)
 		}
 	}
 
 	return nil
 }
 
-func (ipvs *Ipvs) addServiceAndDestinations(svc types.Service, dsts []types.Destination) error {
-	ipvsService := *ToIpvsService(&svc)
-	err := gipvs.AddService(ipvsService)
-	if err != nil {
-		return err
+// snapshotOf builds the statemanager.Snapshot persisted after every
+// successful Sync, so a future restart can reconcile against it instead
+// of flushing the table.
+func snapshotOf(state state.State) statemanager.Snapshot {
+	snapshot := statemanager.Snapshot{
+		Destinations: map[string][]types.Destination{},
 	}
 
-	for _, d := range dsts {
-		err := gipvs.AddDestination(ipvsService, *ToIpvsDestination(&d))
-		if err != nil {
-			return err
-		}
+	for _, s := range state.GetServices() {
+		snapshot.Services = append(snapshot.Services, s)
+		snapshot.Destinations[s.GetId()] = state.GetDestinations(&s)
 	}
 
-	return nil
+	return snapshot
 }
 
 func (ipvs *Ipvs) getStateServicesSet(state state.State) mapset.Set {
@@ -138,6 +139,17 @@ func (ipvs *Ipvs) getStateServicesSet(state state.State) mapset.Set {
 	for _, s := range state.GetServices() {
 		s.Name = ""
 		s.Mode = ""
+		// Algorithm and SessionAffinity are fusis-only annotations:
+		// FromService only ever populates their resolved, kernel-level
+		// counterparts (Scheduler, PersistenceTimeout/Netmask). Resolve
+		// them into those fields before clearing the annotations, or
+		// every annotated service would never match what
+		// getCurrentServicesSet reads back.
+		if err := s.Resolve(); err != nil {
+			log.Errorf("[ipvs] %v", err)
+		}
+		s.Algorithm = ""
+		s.SessionAffinity = types.SessionAffinity{}
 		stateSet.Add(s)
 	}
 
@@ -145,7 +157,7 @@ func (ipvs *Ipvs) getStateServicesSet(state state.State) mapset.Set {
 }
 
 func (ipvs *Ipvs) getCurrentServicesSet() (mapset.Set, error) {
-	svcs, err := gipvs.GetServices()
+	svcs, err := ipvs.backend.GetServices()
 	if err != nil {
 		return nil, err
 	}
@@ -159,31 +171,85 @@ func (ipvs *Ipvs) getCurrentServicesSet() (mapset.Set, error) {
 }
 
 func (ipvs *Ipvs) getStateDestinationsSet(state state.State, svc types.Service) mapset.Set {
-	// checks := state.GetChecks()
 	stateSet := mapset.NewSet()
 
 	// Filter healthy destinations
 	for _, d := range state.GetDestinations(&svc) {
-		// if check, ok := checks[d.GetId()]; ok {
-		// 	if check.Status == health.BAD {
-		// 		continue
-		// 	}
-		// } else { // no healthcheck found
-		// 	continue
-		// }
-
-		// Clean up to match services from kernel
+		if ipvs.health != nil && ipvs.health.Status(d.GetId()) == health.Unhealthy {
+			continue
+		}
+
+		// Clean up to match services from kernel. HealthCheck is a
+		// fusis-only annotation the kernel knows nothing about, so it
+		// must be cleared too or every checked destination would
+		// never match what getCurrentDestinationsSet reads back.
+		// Resolve defaults AddressFamily/ConnectionType the same way
+		// fromDestination does, so an unannotated destination matches
+		// too instead of churning every Sync.
 		d.Name = ""
 		d.ServiceId = ""
+		d.HealthCheck = nil
+		d.Resolve()
 		stateSet.Add(d)
 	}
 
 	return stateSet
 }
 
+// WatchHealth starts a background health checker for every destination
+// that carries a HealthCheck annotation and keeps a live Monitor of
+// their Status, which Sync consults to exclude unhealthy destinations
+// from the stateSet. getState is called to fetch the latest cluster
+// state whenever a destination's health flips, so a check failure or
+// recovery triggers an immediate Sync rather than waiting for the next
+// reconcile tick. Watching stops when ctx is cancelled.
+func (ipvs *Ipvs) WatchHealth(ctx context.Context, getState func() state.State) {
+	ipvs.health = health.NewMonitor(func(dst types.Destination, status health.Status) {
+		log.Infof("[ipvs] destination %s is now %s, resyncing", dst.GetId(), status)
+		if err := ipvs.Sync(getState()); err != nil {
+			log.Errorf("[ipvs] resync after health change failed: %v", err)
+		}
+	})
+
+	for _, svc := range getState().GetServices() {
+		for _, dst := range getState().GetDestinations(&svc) {
+			if dst.HealthCheck == nil {
+				continue
+			}
+
+			cfg := toHealthConfig(dst.HealthCheck)
+			checker, err := health.NewChecker(cfg)
+			if err != nil {
+				log.Errorf("[ipvs] invalid health check for %s: %v", dst.GetId(), err)
+				continue
+			}
+
+			go ipvs.health.Watch(ctx, dst, checker, cfg)
+		}
+	}
+}
+
+// HealthStatus returns the current health status of every destination in
+// state, keyed by destination id, so it can be surfaced over the API.
+// Destinations that are not being watched are reported Healthy.
+func (ipvs *Ipvs) HealthStatus(state state.State) map[string]health.Status {
+	statuses := map[string]health.Status{}
+	if ipvs.health == nil {
+		return statuses
+	}
+
+	for _, svc := range state.GetServices() {
+		for _, dst := range state.GetDestinations(&svc) {
+			statuses[dst.GetId()] = ipvs.health.Status(dst.GetId())
+		}
+	}
+
+	return statuses
+}
+
 func (ipvs *Ipvs) getCurrentDestinationsSet(svc types.Service) (mapset.Set, error) {
 	currentSet := mapset.NewSet()
-	ipvsSvc, err := gipvs.GetService(ToIpvsService(&svc))
+	ipvsSvc, err := ipvs.backend.GetService(ToIpvsService(&svc))
 	if err != nil {
 		return nil, err
 	}
@@ -197,5 +263,5 @@ func (ipvs *Ipvs) getCurrentDestinationsSet(svc types.Service) (mapset.Set, erro
 
 // Flush flushes all services and destinations from the IPVS table.
 func (ipvs *Ipvs) Flush() error {
-	return gipvs.Flush()
+	return ipvs.backend.Flush()
 }
@@ -0,0 +1,272 @@
+package ipvs
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/deckarep/golang-set"
+
+	"github.com/luizbafilho/fusis/state"
+	"github.com/luizbafilho/fusis/statemanager"
+	"github.com/luizbafilho/fusis/types"
+)
+
+// svcIdentity returns the fields that identify a service in the kernel
+// (surviving the Name/Mode/Algorithm/SessionAffinity cleanup the stateSet
+// comparisons do), so a cleared service from a stateSet diff can be
+// matched back against the uncleared service it came from.
+func svcIdentity(s types.Service) string {
+	if s.FWMark != 0 {
+		return fmt.Sprintf("fwmark:%d:%s", s.FWMark, s.Protocol)
+	}
+	return fmt.Sprintf("%s:%d:%s", s.Host, s.Port, s.Protocol)
+}
+
+// destinationDiff is the set of destination adds/removes needed to bring
+// a single service's destinations in line with a desired state.
+type destinationDiff struct {
+	service types.Service
+	adds    []types.Destination
+	removes []types.Destination
+}
+
+// serviceAdd is a service being added along with the full destination
+// set it should be created with.
+type serviceAdd struct {
+	service      types.Service
+	destinations []types.Destination
+}
+
+// plan is a single change set covering every service and destination
+// add/remove needed to bring the kernel's IPVS table in line with a
+// desired state. Building it up front, instead of diffing and applying
+// service by service, lets apply treat the whole sync as one unit:
+// either every op lands, or everything that did land gets rolled back.
+// This is software-level atomicity, not a real netlink transaction:
+// apply still issues one gipvs syscall per op (gipvs has no batch API),
+// so it doesn't cut the number of kernel round-trips a large sync takes.
+type plan struct {
+	serviceAdds    []serviceAdd
+	serviceRemoves []types.Service
+
+	destinationDiffs []destinationDiff
+}
+
+func (p *plan) isEmpty() bool {
+	if len(p.serviceAdds) > 0 || len(p.serviceRemoves) > 0 {
+		return false
+	}
+	for _, d := range p.destinationDiffs {
+		if len(d.adds) > 0 || len(d.removes) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// buildPlan diffs the desired cluster state against whatever backend
+// currently has programmed and returns the single plan needed to bring
+// the two in line.
+func (ipvs *Ipvs) buildPlan(desired state.State) (*plan, error) {
+	stateSet := ipvs.getStateServicesSet(desired)
+	currentSet, err := ipvs.getCurrentServicesSet()
+	if err != nil {
+		return nil, err
+	}
+
+	// getStateServicesSet clears Name before comparing, so look
+	// destinations up against the real (uncleared) service - a cleared
+	// svc has no Name for desired.GetDestinations to match against and
+	// would always return none.
+	realServices := map[string]types.Service{}
+	for _, svc := range desired.GetServices() {
+		realServices[svcIdentity(svc)] = svc
+	}
+
+	p := &plan{}
+	added := map[string]bool{}
+
+	for r := range stateSet.Difference(currentSet).Iter() {
+		svc := r.(types.Service)
+		real := realServices[svcIdentity(svc)]
+		p.serviceAdds = append(p.serviceAdds, serviceAdd{service: svc, destinations: desired.GetDestinations(&real)})
+		added[svcIdentity(svc)] = true
+	}
+
+	for r := range currentSet.Difference(stateSet).Iter() {
+		p.serviceRemoves = append(p.serviceRemoves, r.(types.Service))
+	}
+
+	for _, svc := range desired.GetServices() {
+		// A service being added this sync doesn't exist in the kernel
+		// yet, so diffing its destinations against the (nonexistent)
+		// current set would fail; its full destination list is already
+		// carried on the serviceAdd above. Name is cleared on the
+		// stateSet side, so match on the fields that survive cleanup
+		// instead of GetId.
+		if added[svcIdentity(svc)] {
+			continue
+		}
+
+		diff, err := ipvs.buildDestinationDiff(desired, svc)
+		if err != nil {
+			return nil, err
+		}
+		if len(diff.adds) > 0 || len(diff.removes) > 0 {
+			p.destinationDiffs = append(p.destinationDiffs, diff)
+		}
+	}
+
+	return p, nil
+}
+
+// buildPlanFromSnapshot diffs a persisted statemanager.Snapshot against
+// whatever backend currently has programmed. It is used by New to
+// reconcile instead of flushing the table on startup. Only services are
+// diffed: a service present on both sides keeps the destinations the
+// kernel already has, even where they differ from the snapshot's.
+func (ipvs *Ipvs) buildPlanFromSnapshot(snapshot statemanager.Snapshot) (*plan, error) {
+	desiredSet := mapset.NewSet()
+	// snapshotOf keys Destinations by the real service name, but Name is
+	// cleared below before comparing; capture the destinations under
+	// svcIdentity, which survives the clearing, instead of looking them
+	// up by the now-empty GetId().
+	destinationsByIdentity := map[string][]types.Destination{}
+	for _, s := range snapshot.Services {
+		dsts := snapshot.Destinations[s.GetId()]
+		s.Name = ""
+		s.Mode = ""
+		if err := s.Resolve(); err != nil {
+			log.Errorf("[ipvs] %v", err)
+		}
+		s.Algorithm = ""
+		s.SessionAffinity = types.SessionAffinity{}
+		desiredSet.Add(s)
+		destinationsByIdentity[svcIdentity(s)] = dsts
+	}
+
+	currentSet, err := ipvs.getCurrentServicesSet()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &plan{}
+
+	for r := range desiredSet.Difference(currentSet).Iter() {
+		svc := r.(types.Service)
+		p.serviceAdds = append(p.serviceAdds, serviceAdd{service: svc, destinations: destinationsByIdentity[svcIdentity(svc)]})
+	}
+
+	for r := range currentSet.Difference(desiredSet).Iter() {
+		p.serviceRemoves = append(p.serviceRemoves, r.(types.Service))
+	}
+
+	return p, nil
+}
+
+func (ipvs *Ipvs) buildDestinationDiff(desired state.State, svc types.Service) (destinationDiff, error) {
+	stateSet := ipvs.getStateDestinationsSet(desired, svc)
+	currentSet, err := ipvs.getCurrentDestinationsSet(svc)
+	if err != nil {
+		return destinationDiff{}, err
+	}
+
+	diff := destinationDiff{service: svc}
+	for r := range stateSet.Difference(currentSet).Iter() {
+		diff.adds = append(diff.adds, r.(types.Destination))
+	}
+	for r := range currentSet.Difference(stateSet).Iter() {
+		diff.removes = append(diff.removes, r.(types.Destination))
+	}
+
+	return diff, nil
+}
+
+// appliedOp is an inverse operation recorded as the plan is applied, so
+// apply can unwind everything it has done so far if a later op fails.
+type appliedOp func(backend kernelBackend) error
+
+// apply programs backend to match p, rolling back every op it already
+// applied if any step fails, so kernel state never diverges from what
+// Sync reports as applied. Each add/remove is still one backend call;
+// this buys atomicity, not fewer round-trips.
+func apply(backend kernelBackend, p *plan) error {
+	var undo []appliedOp
+
+	rollback := func(cause error) error {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if err := undo[i](backend); err != nil {
+				log.Errorf("[ipvs] rollback step failed, kernel state may have diverged: %v", err)
+			}
+		}
+		return cause
+	}
+
+	for _, add := range p.serviceAdds {
+		ipvsSvc := *ToIpvsService(&add.service)
+		if err := backend.AddService(ipvsSvc); err != nil {
+			return rollback(err)
+		}
+		undo = append(undo, func(backend kernelBackend) error { return backend.DeleteService(ipvsSvc) })
+
+		for _, d := range add.destinations {
+			d := d
+			if err := backend.AddDestination(ipvsSvc, *ToIpvsDestination(&d)); err != nil {
+				return rollback(err)
+			}
+			undo = append(undo, func(backend kernelBackend) error {
+				return backend.DeleteDestination(ipvsSvc, *ToIpvsDestination(&d))
+			})
+		}
+	}
+
+	for _, diff := range p.destinationDiffs {
+		ipvsSvc := *ToIpvsService(&diff.service)
+
+		for _, d := range diff.adds {
+			d := d
+			if err := backend.AddDestination(ipvsSvc, *ToIpvsDestination(&d)); err != nil {
+				return rollback(err)
+			}
+			undo = append(undo, func(backend kernelBackend) error {
+				return backend.DeleteDestination(ipvsSvc, *ToIpvsDestination(&d))
+			})
+		}
+
+		for _, d := range diff.removes {
+			d := d
+			ipvsDst := *ToIpvsDestination(&d)
+			if err := backend.DeleteDestination(ipvsSvc, ipvsDst); err != nil {
+				return rollback(err)
+			}
+			undo = append(undo, func(backend kernelBackend) error { return backend.AddDestination(ipvsSvc, ipvsDst) })
+		}
+	}
+
+	for _, svc := range p.serviceRemoves {
+		ipvsSvc := *ToIpvsService(&svc)
+		// Deleting a service drops its destinations too, so read them
+		// first for the undo step to restore along with the service.
+		current, err := backend.GetService(&ipvsSvc)
+		if err != nil {
+			return rollback(err)
+		}
+		dsts := current.Destinations
+		if err := backend.DeleteService(ipvsSvc); err != nil {
+			return rollback(err)
+		}
+		undo = append(undo, func(backend kernelBackend) error {
+			if err := backend.AddService(ipvsSvc); err != nil {
+				return err
+			}
+			for _, d := range dsts {
+				if err := backend.AddDestination(ipvsSvc, *d); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	return nil
+}
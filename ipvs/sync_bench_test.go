@@ -0,0 +1,129 @@
+package ipvs
+
+import (
+	"fmt"
+	"testing"
+
+	gipvs "github.com/google/seesaw/ipvs"
+
+	"github.com/luizbafilho/fusis/types"
+)
+
+// fakeBackend is an in-memory kernelBackend used to benchmark plan
+// building and apply's rollback bookkeeping without a real kernel.
+// gipvs issues one netlink call per AddService/AddDestination/etc, and
+// this package doesn't batch those into fewer round-trips (gipvs has no
+// batch API, and extending it to submit an NLM_F_MULTI netlink
+// transaction directly is out of scope here) - so these benchmarks
+// measure this package's own overhead, not real netlink latency, and
+// don't demonstrate a round-trip reduction against the kernel.
+type fakeBackend struct {
+	services map[string]*gipvs.Service
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{services: map[string]*gipvs.Service{}}
+}
+
+func fakeKey(svc gipvs.Service) string {
+	return fmt.Sprintf("%s:%d:%s", svc.Address, svc.Port, svc.Protocol)
+}
+
+func (b *fakeBackend) AddService(svc gipvs.Service) error {
+	cp := svc
+	cp.Destinations = nil
+	b.services[fakeKey(svc)] = &cp
+	return nil
+}
+
+func (b *fakeBackend) DeleteService(svc gipvs.Service) error {
+	delete(b.services, fakeKey(svc))
+	return nil
+}
+
+func (b *fakeBackend) AddDestination(svc gipvs.Service, dst gipvs.Destination) error {
+	s, ok := b.services[fakeKey(svc)]
+	if !ok {
+		return fmt.Errorf("service not found")
+	}
+	s.Destinations = append(s.Destinations, &dst)
+	return nil
+}
+
+func (b *fakeBackend) DeleteDestination(svc gipvs.Service, dst gipvs.Destination) error {
+	s, ok := b.services[fakeKey(svc)]
+	if !ok {
+		return fmt.Errorf("service not found")
+	}
+	for i, d := range s.Destinations {
+		if d.Address == dst.Address && d.Port == dst.Port {
+			s.Destinations = append(s.Destinations[:i], s.Destinations[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (b *fakeBackend) GetServices() ([]*gipvs.Service, error) {
+	svcs := make([]*gipvs.Service, 0, len(b.services))
+	for _, s := range b.services {
+		svcs = append(svcs, s)
+	}
+	return svcs, nil
+}
+
+func (b *fakeBackend) GetService(svc *gipvs.Service) (*gipvs.Service, error) {
+	s, ok := b.services[fakeKey(*svc)]
+	if !ok {
+		return nil, fmt.Errorf("service not found")
+	}
+	return s, nil
+}
+
+func (b *fakeBackend) Flush() error {
+	b.services = map[string]*gipvs.Service{}
+	return nil
+}
+
+// fakeState is a minimal state.State with a single service carrying n
+// destinations, used to drive the sync benchmarks below.
+type fakeState struct {
+	service      types.Service
+	destinations []types.Destination
+}
+
+func (s fakeState) GetServices() []types.Service { return []types.Service{s.service} }
+
+func (s fakeState) GetDestinations(svc *types.Service) []types.Destination {
+	return s.destinations
+}
+
+func benchmarkSync(b *testing.B, n int) {
+	svc := types.Service{Name: "bench", Host: "10.0.0.1", Port: 80, Protocol: "tcp", Scheduler: "wrr"}
+
+	dsts := make([]types.Destination, n)
+	for i := 0; i < n; i++ {
+		dsts[i] = types.Destination{
+			Name:      fmt.Sprintf("dst-%d", i),
+			ServiceId: svc.Name,
+			Host:      fmt.Sprintf("10.0.1.%d", i%255),
+			Port:      8080,
+			Weight:    1,
+		}
+	}
+
+	state := fakeState{service: svc, destinations: dsts}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ipvs := &Ipvs{backend: newFakeBackend()}
+		if err := ipvs.Sync(state); err != nil {
+			b.Fatalf("Sync failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkSync10(b *testing.B)    { benchmarkSync(b, 10) }
+func BenchmarkSync100(b *testing.B)   { benchmarkSync(b, 100) }
+func BenchmarkSync1000(b *testing.B)  { benchmarkSync(b, 1000) }
+func BenchmarkSync10000(b *testing.B) { benchmarkSync(b, 10000) }
@@ -0,0 +1,142 @@
+// Package statemanager persists the last state successfully applied to
+// the IPVS table to disk, so fusisd can recover from a crash or a
+// restart without flushing rules that are still valid. This mirrors the
+// approach netbird's client takes to survive unclean shutdowns of its
+// own networking state.
+package statemanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/luizbafilho/fusis/types"
+)
+
+const (
+	stateBucket = "state"
+	metaBucket  = "meta"
+
+	snapshotKey      = "snapshot"
+	cleanShutdownKey = "clean_shutdown"
+
+	dbFile = "fusis.db"
+)
+
+// Snapshot is the last desired state successfully applied to the kernel.
+// Destinations are kept separately, keyed by service id, because
+// types.Service has no Destinations field of its own.
+type Snapshot struct {
+	Services     []types.Service
+	Destinations map[string][]types.Destination
+}
+
+// Manager persists Snapshots to a BoltDB file under dir and tracks
+// whether the last shutdown was clean.
+type Manager struct {
+	db *bolt.DB
+}
+
+// New opens (creating if necessary) the state database under dir.
+func New(dir string) (*Manager, error) {
+	db, err := bolt.Open(filepath.Join(dir, dbFile), 0600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("[statemanager] opening state db: %v", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists([]byte(stateBucket)); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("[statemanager] creating buckets: %v", err)
+	}
+
+	return &Manager{db: db}, nil
+}
+
+// WasCleanShutdown reports whether the clean-shutdown marker from the
+// previous run is present. WasCleanShutdown clears the marker as it
+// reads it, so any crash before the next Close is correctly detected. It
+// always reports true when no Snapshot has ever been saved, since a
+// brand-new install has no prior run to have crashed.
+func (m *Manager) WasCleanShutdown() (bool, error) {
+	var clean bool
+
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		state := tx.Bucket([]byte(stateBucket))
+		if state.Get([]byte(snapshotKey)) == nil {
+			clean = true
+			return nil
+		}
+
+		meta := tx.Bucket([]byte(metaBucket))
+		clean = meta.Get([]byte(cleanShutdownKey)) != nil
+		return meta.Delete([]byte(cleanShutdownKey))
+	})
+	if err != nil {
+		return false, fmt.Errorf("[statemanager] reading clean shutdown marker: %v", err)
+	}
+
+	return clean, nil
+}
+
+// Load returns the last persisted Snapshot, or a zero Snapshot if none
+// has been saved yet.
+func (m *Manager) Load() (Snapshot, error) {
+	var snap Snapshot
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(stateBucket)).Get([]byte(snapshotKey))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &snap)
+	})
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("[statemanager] loading snapshot: %v", err)
+	}
+
+	return snap, nil
+}
+
+// Save persists snap transactionally, overwriting whatever was saved
+// before. It is meant to be called after every successful Sync.
+func (m *Manager) Save(snap Snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("[statemanager] encoding snapshot: %v", err)
+	}
+
+	err = m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(stateBucket)).Put([]byte(snapshotKey), data)
+	})
+	if err != nil {
+		return fmt.Errorf("[statemanager] saving snapshot: %v", err)
+	}
+
+	return nil
+}
+
+// Close records a clean-shutdown marker and closes the underlying
+// database. If the process dies before Close runs, WasCleanShutdown
+// reports false on the next start and the caller should treat the
+// persisted Snapshot as the source of truth until the cluster state
+// syncs back in.
+func (m *Manager) Close() error {
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(metaBucket)).Put([]byte(cleanShutdownKey), []byte{1})
+	})
+	if err != nil {
+		m.db.Close()
+		return fmt.Errorf("[statemanager] recording clean shutdown marker: %v", err)
+	}
+
+	return m.db.Close()
+}
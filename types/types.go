@@ -0,0 +1,327 @@
+// Package types holds the domain objects shared between the fusis API,
+// store and ipvs packages.
+package types
+
+import "fmt"
+
+// AddressFamily selects between IPv4 and IPv6 for a Service or
+// Destination.
+type AddressFamily string
+
+const (
+	// INET is the default, IPv4 address family.
+	INET AddressFamily = "inet"
+	// INET6 is the IPv6 address family.
+	INET6 AddressFamily = "inet6"
+)
+
+// ConnectionType is the IPVS forwarding method used to reach a
+// Destination.
+type ConnectionType string
+
+const (
+	// NAT rewrites the destination address/port (IP_VS_CONN_F_MASQ).
+	NAT ConnectionType = "nat"
+	// DR forwards via direct routing (IP_VS_CONN_F_DROUTE).
+	DR ConnectionType = "route"
+	// TUN forwards via IP tunnelling (IP_VS_CONN_F_TUNNEL).
+	TUN ConnectionType = "tunnel"
+)
+
+var connectionTypes = map[ConnectionType]bool{NAT: true, DR: true, TUN: true}
+
+// algorithms maps the friendly, user-facing names accepted by Algorithm
+// to the IPVS scheduler short code Scheduler is resolved to.
+var algorithms = map[string]string{
+	"round_robin":                "rr",
+	"least_connections":          "lc",
+	"weighted_least_connections": "wlc",
+	"source_hash":                "sh",
+	"destination_hash":           "dh",
+	"maglev":                     "mh",
+}
+
+// SupportedAlgorithms returns the friendly Algorithm names fusis accepts,
+// for use in validation error messages.
+func SupportedAlgorithms() []string {
+	names := make([]string, 0, len(algorithms))
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	return names
+}
+
+// SessionAffinity pins a client to the same Destination for the
+// lifetime of a session, translating to IPVS persistence.
+type SessionAffinity struct {
+	// Type is "none" (the default) or "client_ip".
+	Type string
+	// Timeout, in seconds, is how long a client is pinned to the same
+	// Destination. Only meaningful when Type is "client_ip".
+	Timeout int
+	// Netmask groups clients into buckets (e.g. a /24) instead of
+	// pinning individual IPs. Only meaningful when Type is "client_ip".
+	Netmask string
+}
+
+const (
+	// SessionAffinityNone disables persistence.
+	SessionAffinityNone = "none"
+	// SessionAffinityClientIP pins a client to the same Destination by
+	// source IP.
+	SessionAffinityClientIP = "client_ip"
+)
+
+// Service represents a virtual service: a vip:port:protocol triple (or a
+// fwmark) that load balances traffic across a set of Destinations.
+type Service struct {
+	Name string
+	Host string
+	Port uint16
+
+	Protocol string
+	Mode     string
+
+	// Algorithm is the friendly, user-facing scheduler name (e.g.
+	// "round_robin", "least_connections"). It is resolved to the IPVS
+	// scheduler short code in Scheduler by ToIpvsService; callers
+	// wanting to read the scheduler that actually got programmed
+	// should use Scheduler, which FromService also populates from the
+	// kernel.
+	Algorithm string
+	// Scheduler is the resolved IPVS scheduler short code (e.g. "rr",
+	// "wlc", "sh"). It is normally derived from Algorithm, but can be
+	// set directly for schedulers with no friendly name yet.
+	Scheduler string
+
+	// SessionAffinity is the friendly, user-facing persistence knob.
+	// It is resolved to PersistenceTimeout/PersistenceNetmask by
+	// ToIpvsService.
+	SessionAffinity SessionAffinity
+
+	// AddressFamily selects IPv4 or IPv6. Defaults to INET.
+	AddressFamily AddressFamily
+
+	// FWMark, when non-zero, turns this into a firewall-mark service:
+	// it matches packets carrying this iptables/nftables mark instead
+	// of Host/Port/Protocol. Mutually exclusive with Host/Port.
+	FWMark uint32
+
+	// PersistenceTimeout, in seconds, enables IPVS persistent
+	// connections: requests from the same client are pinned to the
+	// same Destination for this long. Zero disables persistence.
+	PersistenceTimeout int
+	// PersistenceNetmask groups clients into buckets (e.g. a /24) for
+	// persistence purposes instead of pinning individual IPs. Ignored
+	// when PersistenceTimeout is zero.
+	PersistenceNetmask string
+
+	// SchedFlags carries scheduler-specific flags, currently only
+	// meaningful for the "sh" scheduler.
+	SchedFlags SchedFlags
+}
+
+// SchedFlags are the IP_VS_SVC_F_SCHED_* flags recognised by the sh
+// scheduler.
+type SchedFlags struct {
+	// SHFallback falls back to another destination when the one
+	// selected by the hash is unavailable, instead of dropping.
+	SHFallback bool
+	// SHPort includes the destination port in the source-hash
+	// computation instead of just the address.
+	SHPort bool
+}
+
+// GetId returns the identifier used to key this service in the cluster
+// store. The IPVS stateSet comparisons clear Name and do not use it.
+func (s *Service) GetId() string {
+	return s.Name
+}
+
+// Resolve fills in the kernel-level fields (Scheduler, AddressFamily,
+// PersistenceTimeout, PersistenceNetmask) derived from the friendly
+// Algorithm/SessionAffinity annotations or left at their kernel default,
+// leaving an explicitly set kernel-level field alone. ToIpvsService calls
+// this before converting, and the stateSet comparisons in the ipvs
+// package call it before clearing the annotation fields so added/removed
+// is computed against what actually gets programmed - FromService always
+// reads AddressFamily back as INET or INET6, never "", so leaving it
+// unresolved here would churn every unannotated service forever.
+func (s *Service) Resolve() error {
+	if s.Scheduler == "" {
+		scheduler, err := ResolveScheduler(s.Algorithm)
+		if err != nil {
+			return err
+		}
+		s.Scheduler = scheduler
+	}
+
+	if s.SessionAffinity.Type == SessionAffinityClientIP && s.PersistenceTimeout == 0 {
+		s.PersistenceTimeout = s.SessionAffinity.Timeout
+		s.PersistenceNetmask = s.SessionAffinity.Netmask
+	}
+
+	if s.AddressFamily == "" {
+		s.AddressFamily = INET
+	}
+
+	return nil
+}
+
+// ResolveScheduler resolves a friendly Algorithm name to the IPVS
+// scheduler short code it maps to. An empty algorithm resolves to "rr",
+// IPVS's own default.
+func ResolveScheduler(algorithm string) (string, error) {
+	if algorithm == "" {
+		return "rr", nil
+	}
+
+	scheduler, ok := algorithms[algorithm]
+	if !ok {
+		return "", fmt.Errorf("fusis: unknown algorithm %q, supported: %v", algorithm, SupportedAlgorithms())
+	}
+	return scheduler, nil
+}
+
+// Validate rejects field combinations the kernel doesn't support,
+// instead of letting the IPVS syscalls fail deep in Sync.
+func (s *Service) Validate() error {
+	if s.AddressFamily != "" && s.AddressFamily != INET && s.AddressFamily != INET6 {
+		return fmt.Errorf("fusis: unknown address family %q", s.AddressFamily)
+	}
+
+	if s.FWMark != 0 && (s.Host != "" || s.Port != 0) {
+		return fmt.Errorf("fusis: service %s: fwmark and host/port are mutually exclusive", s.Name)
+	}
+
+	scheduler, err := ResolveScheduler(s.Algorithm)
+	if err != nil {
+		return err
+	}
+	if s.Algorithm != "" && s.Scheduler != "" && s.Scheduler != scheduler {
+		return fmt.Errorf("fusis: service %s: scheduler %q doesn't match algorithm %q", s.Name, s.Scheduler, s.Algorithm)
+	}
+
+	// Scheduler can be set directly with no Algorithm, so fall back to it
+	// for the sh-flags check instead of the "rr" ResolveScheduler("")
+	// would otherwise report.
+	effectiveScheduler := scheduler
+	if s.Algorithm == "" && s.Scheduler != "" {
+		effectiveScheduler = s.Scheduler
+	}
+	if (s.SchedFlags.SHFallback || s.SchedFlags.SHPort) && effectiveScheduler != "sh" {
+		return fmt.Errorf("fusis: service %s: sched flags only apply to the sh scheduler", s.Name)
+	}
+
+	switch s.SessionAffinity.Type {
+	case "", SessionAffinityNone, SessionAffinityClientIP:
+	default:
+		return fmt.Errorf("fusis: service %s: unknown session affinity %q", s.Name, s.SessionAffinity.Type)
+	}
+
+	if s.PersistenceNetmask != "" && s.PersistenceTimeout == 0 && s.SessionAffinity.Type != SessionAffinityClientIP {
+		return fmt.Errorf("fusis: service %s: persistence netmask set without a persistence timeout", s.Name)
+	}
+
+	return nil
+}
+
+// Destination represents a single real server backing a Service.
+type Destination struct {
+	Name      string
+	ServiceId string
+
+	Host   string
+	Port   uint16
+	Weight int
+
+	// AddressFamily selects IPv4 or IPv6. Defaults to INET.
+	AddressFamily AddressFamily
+
+	// ConnectionType is the forwarding method used to reach this
+	// destination. Defaults to NAT.
+	ConnectionType ConnectionType
+
+	// UpperThreshold caps the number of active connections this
+	// destination is given before it's treated as overloaded. Zero
+	// means unlimited.
+	UpperThreshold uint32
+	// LowerThreshold is the connection count the destination must drop
+	// back below before it's handed new connections again.
+	LowerThreshold uint32
+
+	// HealthCheck configures how this destination's availability is
+	// probed. A nil HealthCheck means the destination is always
+	// considered healthy.
+	HealthCheck *HealthCheck `json:"HealthCheck,omitempty"`
+}
+
+// HealthCheck is the user-facing health check annotation for a
+// Destination. The health package's own Config mirrors these fields;
+// ipvs.toHealthConfig translates between the two so that types has no
+// dependency on health.
+type HealthCheck struct {
+	// Type selects the probe: "tcp" (the default), "http", "https" or
+	// "script".
+	Type string
+
+	IntervalSeconds int
+	TimeoutSeconds  int
+
+	HealthyThreshold   int
+	UnhealthyThreshold int
+
+	// HTTP(S)
+	Path           string
+	ExpectedStatus int
+	ExpectedBody   string
+
+	// Script
+	Command string
+	Args    []string
+}
+
+// GetId returns the identifier used to key this destination's health
+// status. The IPVS stateSet comparisons clear Name and do not use it.
+func (d *Destination) GetId() string {
+	return d.Name
+}
+
+// Resolve fills AddressFamily and ConnectionType with their kernel
+// defaults (INET, NAT) when left unset. fromDestination always reads
+// them back as one of these, never "", so the stateSet comparisons in
+// the ipvs package call this before comparing or an unannotated
+// destination would churn add-then-remove forever.
+func (d *Destination) Resolve() {
+	if d.AddressFamily == "" {
+		d.AddressFamily = INET
+	}
+	if d.ConnectionType == "" {
+		d.ConnectionType = NAT
+	}
+}
+
+// Validate rejects field combinations the kernel doesn't support.
+func (d *Destination) Validate() error {
+	if d.AddressFamily != "" && d.AddressFamily != INET && d.AddressFamily != INET6 {
+		return fmt.Errorf("fusis: unknown address family %q", d.AddressFamily)
+	}
+
+	if d.ConnectionType != "" && !connectionTypes[d.ConnectionType] {
+		return fmt.Errorf("fusis: unknown connection type %q", d.ConnectionType)
+	}
+
+	if d.UpperThreshold != 0 && d.LowerThreshold > d.UpperThreshold {
+		return fmt.Errorf("fusis: destination %s: lower threshold must not exceed upper threshold", d.Name)
+	}
+
+	if d.HealthCheck != nil {
+		switch d.HealthCheck.Type {
+		case "", "tcp", "http", "https", "script":
+		default:
+			return fmt.Errorf("fusis: destination %s: unknown health check type %q", d.Name, d.HealthCheck.Type)
+		}
+	}
+
+	return nil
+}